@@ -0,0 +1,11 @@
+package gostream
+
+import peer "github.com/libp2p/go-libp2p-core/peer"
+
+// addr implements net.Addr for a libp2p peer. It lets code that only knows
+// about net.Conn (net/http, net/rpc, ...) print something sensible for the
+// remote side of a stream, even though there's no IP or port underneath.
+type addr struct{ id peer.ID }
+
+func (a addr) Network() string { return "libp2p" }
+func (a addr) String() string  { return a.id.Pretty() }
@@ -0,0 +1,31 @@
+package gostream
+
+import (
+	"net"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-core/network"
+)
+
+// conn adapts a libp2p stream to the net.Conn interface so it can be handed
+// to anything written against the standard library, e.g. http.Serve.
+type conn struct {
+	inet.Stream
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return addr{c.Conn().LocalPeer()}
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return addr{c.Conn().RemotePeer()}
+}
+
+// SetDeadline satisfies net.Conn by applying the same deadline to both
+// directions, matching how inet.Stream splits read/write deadlines.
+func (c *conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -0,0 +1,67 @@
+// Package gostream exposes a libp2p protocol as a net.Listener, so any
+// net.Conn-based protocol (HTTP, gRPC, SSH, ...) can be layered on top of a
+// libp2p stream without touching inet.Stream directly. It mirrors the
+// go-libp2p-gostream design later merged into go-libp2p itself.
+package gostream
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	host "github.com/libp2p/go-libp2p-core/host"
+	inet "github.com/libp2p/go-libp2p-core/network"
+	protocol "github.com/libp2p/go-libp2p-core/protocol"
+)
+
+type listener struct {
+	host     host.Host
+	tag      protocol.ID
+	streamCh chan inet.Stream
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewListener registers tag as a stream handler on h and returns a
+// net.Listener whose Accept() hands back one net.Conn per inbound stream.
+// Closing the listener unregisters the handler.
+func NewListener(h host.Host, tag protocol.ID) (net.Listener, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &listener{
+		host:     h,
+		tag:      tag,
+		streamCh: make(chan inet.Stream),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	h.SetStreamHandler(tag, func(s inet.Stream) {
+		select {
+		case l.streamCh <- s:
+		case <-l.ctx.Done():
+			s.Reset()
+		}
+	})
+
+	return l, nil
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.streamCh:
+		return &conn{Stream: s}, nil
+	case <-l.ctx.Done():
+		return nil, fmt.Errorf("listener closed")
+	}
+}
+
+func (l *listener) Close() error {
+	l.host.RemoveStreamHandler(l.tag)
+	l.cancel()
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return addr{l.host.ID()}
+}
@@ -0,0 +1,108 @@
+// Package pb defines the wire message for the /ping/2.0.0 protocol.
+//
+// It is a hand-written, dependency-free encoder/decoder for the
+// PingMessage described in ping.proto, using plain protobuf wire format
+// (varint and length-delimited fields) so it stays compatible with any
+// real protobuf implementation on the other end.
+package pb
+
+import (
+	"fmt"
+
+	varint "github.com/multiformats/go-varint"
+)
+
+// PingMessage mirrors the proto3 message in ping.proto:
+//
+//	message PingMessage {
+//	    uint64 seq = 1;
+//	    bytes payload = 2;
+//	    int64 send_ns = 3;
+//	}
+type PingMessage struct {
+	Seq     uint64
+	Payload []byte
+	SendNs  int64
+}
+
+const (
+	fieldSeq     = 1
+	fieldPayload = 2
+	fieldSendNs  = 3
+
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func tag(field, wireType int) uint64 {
+	return uint64(field<<3 | wireType)
+}
+
+// Marshal encodes m using the protobuf wire format.
+func (m *PingMessage) Marshal() ([]byte, error) {
+	var buf []byte
+
+	if m.Seq != 0 {
+		buf = varint.ToUvarint(tag(fieldSeq, wireVarint))
+		buf = append(buf, varint.ToUvarint(m.Seq)...)
+	}
+
+	if len(m.Payload) > 0 {
+		buf = append(buf, varint.ToUvarint(tag(fieldPayload, wireBytes))...)
+		buf = append(buf, varint.ToUvarint(uint64(len(m.Payload)))...)
+		buf = append(buf, m.Payload...)
+	}
+
+	if m.SendNs != 0 {
+		buf = append(buf, varint.ToUvarint(tag(fieldSendNs, wireVarint))...)
+		buf = append(buf, varint.ToUvarint(uint64(m.SendNs))...)
+	}
+
+	return buf, nil
+}
+
+// Unmarshal decodes m from the protobuf wire format produced by Marshal.
+func (m *PingMessage) Unmarshal(data []byte) error {
+	*m = PingMessage{}
+
+	for len(data) > 0 {
+		key, n, err := varint.FromUvarint(data)
+		if err != nil {
+			return fmt.Errorf("ping: read tag: %w", err)
+		}
+		data = data[n:]
+
+		field, wireType := int(key>>3), int(key&0x7)
+		switch wireType {
+		case wireVarint:
+			v, n, err := varint.FromUvarint(data)
+			if err != nil {
+				return fmt.Errorf("ping: read varint field %d: %w", field, err)
+			}
+			data = data[n:]
+			switch field {
+			case fieldSeq:
+				m.Seq = v
+			case fieldSendNs:
+				m.SendNs = int64(v)
+			}
+		case wireBytes:
+			size, n, err := varint.FromUvarint(data)
+			if err != nil {
+				return fmt.Errorf("ping: read length field %d: %w", field, err)
+			}
+			data = data[n:]
+			if uint64(len(data)) < size {
+				return fmt.Errorf("ping: truncated field %d", field)
+			}
+			if field == fieldPayload {
+				m.Payload = append([]byte(nil), data[:size]...)
+			}
+			data = data[size:]
+		default:
+			return fmt.Errorf("ping: unsupported wire type %d for field %d", wireType, field)
+		}
+	}
+
+	return nil
+}
@@ -3,19 +3,37 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/rand"
 	"flag"
 	"fmt"
+	"io"
+	mrand "math/rand"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
-	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
 	iaddr "github.com/ipfs/go-ipfs-addr"
+	"github.com/leslie-wang/go-libp2p-examples/gostream"
+	"github.com/leslie-wang/go-libp2p-examples/ping/pb"
 	libp2p "github.com/libp2p/go-libp2p"
+	crypto "github.com/libp2p/go-libp2p-core/crypto"
+	host "github.com/libp2p/go-libp2p-core/host"
+	network "github.com/libp2p/go-libp2p-core/network"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	peerstore "github.com/libp2p/go-libp2p-core/peerstore"
+	protocol "github.com/libp2p/go-libp2p-core/protocol"
+	discovery "github.com/libp2p/go-libp2p-discovery"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
-	inet "github.com/libp2p/go-libp2p-net"
-	pstore "github.com/libp2p/go-libp2p-peerstore"
-	protocol "github.com/libp2p/go-libp2p-protocol"
-	mh "github.com/multiformats/go-multihash"
+	dhtopts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	routedhost "github.com/libp2p/go-libp2p/p2p/host/routed"
+	relayv2 "github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/relay"
+	ma "github.com/multiformats/go-multiaddr"
+	varint "github.com/multiformats/go-varint"
 )
 
 // IPFS bootstrap nodes. Used to find other peers in the network.
@@ -28,21 +46,131 @@ var bootstrapPeers = []string{
 }
 
 var rendezvous = "meet me here"
-var pingURL = protocol.ID("/v1/ping")
 
-func handleStream(stream inet.Stream) {
+// pingURLv1 is kept registered alongside pingURLv2 so older peers that only
+// speak the newline-framed protocol can still ping us.
+var pingURLv1 = protocol.ID("/v1/ping")
+var pingURLv2 = protocol.ID("/ping/2.0.0")
+
+// pingVersion is the version this binary speaks and the one it asks the
+// other side to negotiate down to during the v2 handshake.
+const pingVersion = 2
+
+// maxPingMessageSize bounds the length prefix readPingMessage will accept,
+// so a peer can't make us allocate an arbitrary amount of memory by sending
+// an oversized frame header before any payload has even arrived.
+const maxPingMessageSize = 64 * 1024
+
+// handshake exchanges the supported protocol version over rw: each side
+// writes its version as a varint and reads the peer's back. It returns the
+// lower of the two, which is what both ends proceed to speak. There's only
+// one version today, but the exchange is what lets a future v3 add
+// features without breaking v2 peers.
+func handshake(rw *bufio.ReadWriter) (int, error) {
+	if err := varint.WriteUvarint(rw, uint64(pingVersion)); err != nil {
+		return 0, err
+	}
+	if err := rw.Flush(); err != nil {
+		return 0, err
+	}
+
+	peerVersion, err := varint.ReadUvarint(rw)
+	if err != nil {
+		return 0, err
+	}
+
+	negotiated := pingVersion
+	if int(peerVersion) < negotiated {
+		negotiated = int(peerVersion)
+	}
+	return negotiated, nil
+}
+
+// writePingMessage length-prefixes msg with a varint and writes it to rw.
+func writePingMessage(rw *bufio.ReadWriter, msg *pb.PingMessage) error {
+	data, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := varint.WriteUvarint(rw, uint64(len(data))); err != nil {
+		return err
+	}
+	if _, err := rw.Write(data); err != nil {
+		return err
+	}
+	return rw.Flush()
+}
+
+// readPingMessage reads one varint-length-prefixed PingMessage from rw.
+func readPingMessage(rw *bufio.ReadWriter) (*pb.PingMessage, error) {
+	size, err := varint.ReadUvarint(rw)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxPingMessageSize {
+		return nil, fmt.Errorf("ping message of %d bytes exceeds max of %d", size, maxPingMessageSize)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(rw, data); err != nil {
+		return nil, err
+	}
+
+	msg := &pb.PingMessage{}
+	if err := msg.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// handleStreamV2 serves the /ping/2.0.0 protocol: negotiate a version, then
+// echo back every PingMessage with its payload replaced by "pong", so the
+// client can compute RTT itself from the send_ns it round-tripped.
+func handleStreamV2(stream network.Stream) {
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+
+	if _, err := handshake(rw); err != nil {
+		fmt.Printf("handshake error: %v", err)
+		return
+	}
+
+	for {
+		msg, err := readPingMessage(rw)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("read ping message error: %v", err)
+			}
+			return
+		}
+
+		fmt.Printf("received - seq=%d payload=%q\n", msg.Seq, msg.Payload)
+
+		reply := &pb.PingMessage{Seq: msg.Seq, Payload: []byte("pong"), SendNs: msg.SendNs}
+		if err := writePingMessage(rw, reply); err != nil {
+			fmt.Printf("write ping message error: %v", err)
+			return
+		}
+	}
+}
+
+// handleStream serves the original newline-framed /v1/ping protocol. The
+// read/write halves are plain *bufio.Reader/*bufio.Writer rather than a
+// bound *bufio.ReadWriter, so readData/writeData also run unchanged behind
+// the gostream adapter, where the reader is an *http.Request body and the
+// writer an http.ResponseWriter instead of a raw stream.
+func handleStream(stream network.Stream) {
 	fmt.Println("Got a new stream!")
 
 	// Create a buffer stream for non blocking read and write.
 	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
 
-	readData(rw)
-	writeData(rw, "pong")
+	readData(rw.Reader)
+	writeData(rw.Writer, "pong")
 
 	// 'stream' will stay open until you close it (or the other side closes it).
 }
-func readData(rw *bufio.ReadWriter) {
-	str, err := rw.ReadString('\n')
+func readData(r *bufio.Reader) {
+	str, err := r.ReadString('\n')
 	if err != nil {
 		fmt.Printf("read data error: %v", err)
 		return
@@ -51,77 +179,355 @@ func readData(rw *bufio.ReadWriter) {
 	fmt.Printf("received - %s", str)
 }
 
-func writeData(rw *bufio.ReadWriter, data string) {
+func writeData(w *bufio.Writer, data string) {
 	fmt.Printf("send - %s\n", data)
-	if _, err := rw.WriteString(fmt.Sprintf("%s\n", data)); err != nil {
+	if _, err := w.WriteString(fmt.Sprintf("%s\n", data)); err != nil {
 		fmt.Printf("send data error: %v", err)
 	}
-	rw.Flush()
+	w.Flush()
+}
+
+// runPubsub joins the gossipsub topic named after rendezvousString, publishes
+// "ping" once a second and prints "pong" replies. Any message seen from a
+// peer other than ourselves is answered with "pong" on the same topic, so a
+// swarm of nodes running with -pubsub all converge on a noisy ping/pong chat
+// instead of pairing up 1:1 like the stream-based mode does.
+func runPubsub(ctx context.Context, host host.Host, rendezvousString string) error {
+	ps, err := pubsub.NewGossipSub(ctx, host)
+	if err != nil {
+		return err
+	}
+
+	topic, err := ps.Join(rendezvousString)
+	if err != nil {
+		return err
+	}
+
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			if err := topic.Publish(ctx, []byte("ping")); err != nil {
+				fmt.Printf("publish error: %v", err)
+			}
+		}
+	}()
+
+	for {
+		msg, err := sub.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if msg.ReceivedFrom == host.ID() {
+			continue
+		}
+
+		fmt.Printf("received - %s from %s\n", msg.Data, msg.ReceivedFrom)
+		if err := topic.Publish(ctx, []byte("pong")); err != nil {
+			fmt.Printf("publish error: %v", err)
+		}
+	}
+}
+
+// generateKeyPair derives an Ed25519 key deterministically from seed, or from
+// the system CSPRNG when seed is zero. A deterministic key gives the node a
+// stable peer ID across restarts, which is what lets other nodes hard-code
+// it in their -bootstrap list.
+func generateKeyPair(seed int64) (crypto.PrivKey, crypto.PubKey, error) {
+	var r io.Reader
+	if seed == 0 {
+		r = rand.Reader
+	} else {
+		r = mrand.New(mrand.NewSource(seed))
+	}
+	return crypto.GenerateKeyPairWithReader(crypto.Ed25519, -1, r)
+}
+
+// makeRoutedHost builds a libp2p host backed by a Kademlia DHT and wraps it
+// with a routed host, so callers can open streams to a peer ID alone and
+// have the DHT resolve its addresses on demand. The DHT is given an
+// in-memory, mutex-wrapped datastore so provider/peer records survive for
+// the life of the process without needing an external store. The same,
+// already-bootstrapped DHT is returned alongside the host: callers need it
+// for their own Advertise/FindPeers calls, and building a second one over
+// the same host would just replace its stream handler and start out empty.
+func makeRoutedHost(listenPort int, seed int64, bootstrapPeers []peer.AddrInfo, extraOpts ...libp2p.Option) (host.Host, *dht.IpfsDHT, error) {
+	priv, _, err := generateKeyPair(seed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx := context.Background()
+
+	opts := []libp2p.Option{
+		libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", listenPort)),
+		libp2p.Identity(priv),
+		libp2p.NATPortMap(),
+		libp2p.DefaultTransports,
+	}
+	opts = append(opts, extraOpts...)
+
+	basicHost, err := libp2p.New(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dstore := dsync.MutexWrap(ds.NewMapDatastore())
+	kadDht, err := dht.New(ctx, basicHost, dhtopts.Datastore(dstore))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	routedHost := routedhost.Wrap(basicHost, kadDht)
+
+	for _, pinfo := range bootstrapPeers {
+		if err := routedHost.Connect(ctx, pinfo); err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("Connection established with bootstrap node: ", pinfo)
+		}
+	}
+
+	if err := kadDht.Bootstrap(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	return routedHost, kadDht, nil
+}
+
+// relayRendezvous namespaces the relay-advertisement separately from the
+// regular rendezvous string, so a -relay node and a plain peer sharing the
+// same -r value don't get confused for one another by FindPeers.
+func relayRendezvous(rendezvousString string) string {
+	return rendezvousString + "-relay"
+}
+
+// relayDHTHolder synchronizes access to the DHT used by the AutoRelay peer
+// source. libp2p.New can start calling the peer source as soon as it
+// returns, which is before makeRoutedHost has handed the DHT it built back
+// to main, so get/set need to be safe to call from different goroutines.
+type relayDHTHolder struct {
+	mu  sync.Mutex
+	dht *dht.IpfsDHT
+}
+
+func (h *relayDHTHolder) set(d *dht.IpfsDHT) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dht = d
+}
+
+func (h *relayDHTHolder) get() *dht.IpfsDHT {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dht
+}
+
+func parseBootstrapPeers(csv string) ([]peer.AddrInfo, error) {
+	if csv == "" {
+		return nil, nil
+	}
+
+	var peers []peer.AddrInfo
+	for _, s := range strings.Split(csv, ",") {
+		addr, err := iaddr.ParseString(s)
+		if err != nil {
+			return nil, err
+		}
+		pinfo, err := peer.AddrInfoFromP2pAddr(addr.Multiaddr())
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, *pinfo)
+	}
+	return peers, nil
 }
 
 func main() {
 	help := flag.Bool("h", false, "Display Help")
 	rendezvousString := flag.String("r", rendezvous, "Unique string to identify group of nodes. Share this with your friends to let them connect with you")
 	listen := flag.Bool("l", false, "Work as server")
+	usePubsub := flag.Bool("pubsub", false, "Broadcast ping/pong over a gossipsub topic instead of a direct stream")
+	port := flag.Int("port", 0, "Port to listen on, 0 picks a random free port")
+	seed := flag.Int64("seed", 0, "Seed to derive a deterministic peer ID from, 0 generates a random identity")
+	bootstrap := flag.String("bootstrap", "", "Comma separated list of multiaddrs to bootstrap from, defaults to the public IPFS bootstrap nodes")
+	httpMode := flag.Bool("http", false, "Serve an HTTP /ping endpoint over the libp2p stream instead of the plain ping/pong protocol")
+	relayMode := flag.Bool("relay", false, "Run as a circuit relay v2 service, advertising itself under the rendezvous")
+	autorelay := flag.Bool("autorelay", false, "Enable AutoRelay, using relays discovered via the DHT as a peer source")
+	relayPeer := flag.String("relay-peer", "", "Multiaddr of a known relay, used to dial /p2p-circuit when a direct stream fails")
 	flag.Parse()
 
 	if *help {
 		fmt.Printf("This program demonstrates a simple ping using libp2p\n\n")
 		fmt.Printf("Usage: Run './ping -l' as listener mode, which reply pong; another terminal run './ping' to send ping to peer and receiver reply\n")
+		fmt.Printf("Run './ping -pubsub' on any number of terminals to broadcast ping/pong over gossipsub instead\n")
+		fmt.Printf("Run './ping -port 4001 -seed 1' then './ping -port 4002 -bootstrap <addr from the first node>' to chain nodes with stable peer IDs\n")
+		fmt.Printf("Run './ping -http' to serve an HTTP /ping endpoint over a libp2p stream instead\n")
+		fmt.Printf("Run './ping -relay' to act as a circuit relay v2 service; run others with '-autorelay' or '-relay-peer <relay addr>' to reach NAT-bound peers through it\n")
 
 		os.Exit(0)
 	}
 
 	ctx := context.Background()
 
-	// libp2p.New constructs a new libp2p Host.
-	// Other options can be added here.
-	host, err := libp2p.New(ctx)
+	peers, err := parseBootstrapPeers(*bootstrap)
 	if err != nil {
 		panic(err)
 	}
+	if peers == nil {
+		peers, err = parseBootstrapPeers(strings.Join(bootstrapPeers, ","))
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	// Set a function as stream handler.
-	// This function is called when a peer initiate a connection and starts a stream with this peer.
-	host.SetStreamHandler(pingURL, handleStream)
+	// autorelay needs a peer source that searches the DHT for relays
+	// advertised under relayRendezvous, but the DHT itself isn't built until
+	// after the host is, and AutoRelay may call the peer source concurrently
+	// as soon as libp2p.New returns. relayDHT guards the handoff so that
+	// race is safe; get() just returns nil, which the source tolerates,
+	// until set() runs once the DHT exists.
+	var relayOpts []libp2p.Option
+	var relayDHT relayDHTHolder
+	if *autorelay {
+		peerSource := func(ctx context.Context, num int) <-chan peer.AddrInfo {
+			ch := make(chan peer.AddrInfo)
+			go func() {
+				defer close(ch)
+				d := relayDHT.get()
+				if d == nil {
+					return
+				}
+				tctx, cancel := context.WithTimeout(ctx, time.Second*10)
+				defer cancel()
+				found, err := discovery.NewRoutingDiscovery(d).FindPeers(tctx, relayRendezvous(*rendezvousString))
+				if err != nil {
+					return
+				}
+				sent := 0
+				for p := range found {
+					if sent >= num {
+						return
+					}
+					select {
+					case ch <- p:
+						sent++
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			return ch
+		}
+		relayOpts = append(relayOpts, libp2p.EnableAutoRelayWithPeerSource(peerSource), libp2p.EnableHolePunching())
+	}
 
-	kadDht, err := dht.New(ctx, host)
+	host, kadDht, err := makeRoutedHost(*port, *seed, peers, relayOpts...)
 	if err != nil {
 		panic(err)
 	}
+	relayDHT.set(kadDht)
 
-	// Let's connect to the bootstrap nodes first. They will tell us about the other nodes in the network.
-	for _, peerAddr := range bootstrapPeers {
-		addr, _ := iaddr.ParseString(peerAddr)
-		peerinfo, _ := pstore.InfoFromP2pAddr(addr.Multiaddr())
+	if *httpMode {
+		// The handler below speaks the plain newline-framed protocol via
+		// readData/writeData, not the versioned pingURLv2 handshake, so the
+		// listener is registered under pingURLv1 to match what it actually
+		// serves.
+		ln, err := gostream.NewListener(host, pingURLv1)
+		if err != nil {
+			panic(err)
+		}
+		defer ln.Close()
 
-		if err := host.Connect(ctx, *peerinfo); err != nil {
-			fmt.Println(err)
-		} else {
-			fmt.Println("Connection established with bootstrap node: ", *peerinfo)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+			readData(bufio.NewReader(r.Body))
+			bw := bufio.NewWriter(w)
+			writeData(bw, "pong")
+		})
+
+		fmt.Printf("serving /ping over libp2p as %v\n", host.ID())
+		if err := http.Serve(ln, mux); err != nil {
+			panic(err)
 		}
+		return
 	}
 
-	// We use a rendezvous point "meet me here" to announce our location.
-	// This is like telling your friends to meet you at the Eiffel Tower.
-	v1b := cid.V1Builder{Codec: cid.Raw, MhType: mh.SHA2_256}
-	rendezvousPoint, _ := v1b.Sum([]byte(*rendezvousString))
+	// Set a function as stream handler.
+	// This function is called when a peer initiate a connection and starts a stream with this peer.
+	// Both protocol versions are registered: new peers speak pingURLv2,
+	// older ones still get a reply on pingURLv1.
+	host.SetStreamHandler(pingURLv1, handleStream)
+	host.SetStreamHandler(pingURLv2, handleStreamV2)
+
+	if *relayMode {
+		if _, err := relayv2.New(host); err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("running as a circuit relay v2 service: %v\n", host.ID())
+		rtctx, rcancel := context.WithTimeout(ctx, time.Second*10)
+		defer rcancel()
+		if _, err := discovery.NewRoutingDiscovery(kadDht).Advertise(rtctx, relayRendezvous(*rendezvousString)); err != nil {
+			panic(err)
+		}
+		select {}
+	}
+
+	// Use a RoutingDiscovery over the DHT to advertise and find the
+	// rendezvous string. This replaces manually hashing the rendezvous into
+	// a CID and calling Provide/FindProviders directly, and is what lets the
+	// pubsub path below open connections opportunistically: gossipsub only
+	// needs *some* peers in its mesh, it doesn't care who found them.
+	routingDiscovery := discovery.NewRoutingDiscovery(kadDht)
 
 	fmt.Printf("announcing ourselves...: %v\n", host.ID())
 	tctx, cancel := context.WithTimeout(ctx, time.Second*10)
 	defer cancel()
-	if err := kadDht.Provide(tctx, rendezvousPoint, true); err != nil {
+	if _, err := routingDiscovery.Advertise(tctx, *rendezvousString); err != nil {
 		panic(err)
 	}
 
+	if *usePubsub {
+		go func() {
+			for {
+				time.Sleep(time.Second)
+				fmt.Println("searching for other peers...")
+				tctx, cancel := context.WithTimeout(ctx, time.Second*10)
+				peers, err := routingDiscovery.FindPeers(tctx, *rendezvousString)
+				cancel()
+				if err != nil {
+					fmt.Printf("find peers error: %v", err)
+					continue
+				}
+				for p := range peers {
+					if p.ID == host.ID() {
+						continue
+					}
+					if err := host.Connect(ctx, p); err != nil {
+						continue
+					}
+				}
+			}
+		}()
+
+		if err := runPubsub(ctx, host, *rendezvousString); err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	if *listen {
 		select {}
 	}
 
-	// Now, look for others who have announced
-	// This is like your friend telling you the location to meet you.
-	// 'FindProviders' will return 'PeerInfo' of all the peers which
-	// have 'Provide' or announced themselves previously.
+	// Now, look for others who have announced. The host is routed, so
+	// NewStream below only needs a peer ID: the DHT resolves addresses on
+	// demand, even for peers FindPeers returned without any addrs.
 	found := false
 	for {
 		time.Sleep(time.Second)
@@ -132,28 +538,58 @@ func main() {
 		fmt.Println("searching for other peers...")
 		tctx, cancel = context.WithTimeout(ctx, time.Second*10)
 		defer cancel()
-		peers, err := kadDht.FindProviders(tctx, rendezvousPoint)
+		peers, err := routingDiscovery.FindPeers(tctx, *rendezvousString)
 		if err != nil {
-			fmt.Printf("find providers error: %v", err)
+			fmt.Printf("find peers error: %v", err)
 			continue
 		}
-		for _, p := range peers {
-			if p.ID == host.ID() || len(p.Addrs) == 0 {
-				// No sense connecting to ourselves or if addrs are not available
+		for p := range peers {
+			if p.ID == host.ID() {
+				// No sense connecting to ourselves
 				continue
 			}
 
-			stream, err := host.NewStream(ctx, p.ID, pingURL)
+			stream, err := host.NewStream(ctx, p.ID, pingURLv2)
+			if err != nil && *relayPeer != "" {
+				// Direct dial failed, likely because p sits behind a NAT.
+				// Fall back to a /p2p-circuit address through the known
+				// relay, then retry the stream.
+				circuitAddr, cerr := ma.NewMultiaddr(fmt.Sprintf("%s/p2p-circuit/p2p/%s", *relayPeer, p.ID.Pretty()))
+				if cerr == nil {
+					host.Peerstore().AddAddr(p.ID, circuitAddr, peerstore.TempAddrTTL)
+					stream, err = host.NewStream(ctx, p.ID, pingURLv2)
+				}
+			}
 			if err != nil {
 				fmt.Printf("new stream: %v", err)
 				continue
 			}
 			rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
 
+			if _, err := handshake(rw); err != nil {
+				fmt.Printf("handshake error: %v", err)
+				continue
+			}
+
 			go func() {
+				var seq uint64
 				for {
-					writeData(rw, "ping")
-					readData(rw)
+					seq++
+					sendNs := time.Now().UnixNano()
+					if err := writePingMessage(rw, &pb.PingMessage{Seq: seq, Payload: []byte("ping"), SendNs: sendNs}); err != nil {
+						fmt.Printf("write ping message error: %v", err)
+						return
+					}
+
+					reply, err := readPingMessage(rw)
+					if err != nil {
+						fmt.Printf("read ping message error: %v", err)
+						return
+					}
+
+					rtt := time.Duration(time.Now().UnixNano() - reply.SendNs)
+					fmt.Printf("received - seq=%d payload=%q rtt=%s\n", reply.Seq, reply.Payload, rtt)
+
 					time.Sleep(time.Second)
 				}
 			}()